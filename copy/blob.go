@@ -11,16 +11,110 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// copyBlobFromStream copies a blob with srcInfo (with known Digest and Annotations and possibly known Size) from srcReader to dest,
+// copyBlobFromStream copies a blob with srcInfo (with known Annotations and possibly known Size) from srcReader to dest,
 // perhaps sending a copy to an io.Writer if getOriginalLayerCopyWriter != nil,
 // perhaps (de/re/)compressing it if canModifyBlob,
+// running any c.additionalBlobPipelineStages registered by the caller,
 // and returns a complete blobInfo of the copied blob.
+// srcInfo.Digest may be "" if the source only knows the blob’s digest once srcReader has been
+// read to EOF (e.g. it is itself being streamed from somewhere); the actual digest is computed
+// on the fly and filled into the returned blobInfo and the blob info cache.
 func (c *copier) copyBlobFromStream(ctx context.Context, srcReader io.Reader, srcInfo types.BlobInfo,
 	getOriginalLayerCopyWriter func(decompressor compressiontypes.DecompressorFunc) io.Writer,
-	canModifyBlob bool, isConfig bool, toEncrypt bool, bar *progressBar, layerIndex int, emptyLayer bool) (types.BlobInfo, error) {
+	canModifyBlob bool, isConfig bool, toEncrypt bool, bar *progressBar, layerIndex int, emptyLayer bool) (uploadedInfo types.BlobInfo, err error) {
 	if isConfig { // This is guaranteed by the caller, but set it here to be explicit.
 		canModifyBlob = false
 	}
+	// blobPipelineCompressionStep's cache lookups key on srcInfo.Digest; if the source doesn't know
+	// its digest until the stream has been read to EOF, there is nothing yet to look up or record
+	// a cache entry against, so recompressing here would be unverifiable. Skip it in that case.
+	if srcInfo.Digest == "" {
+		canModifyBlob = false
+	}
+	// A checkpoint saved for this blob must stay valid no matter how many times the upload is
+	// retried, which means the stream dest eventually receives has to be byte-for-byte identical
+	// on every attempt; recompressing the blob differently from one attempt to the next would
+	// break that. So this is forced off for the whole blob whenever a checkpoint might be saved
+	// against it, not only once an actual resume is under way (see BlobResumeCheckpoint).
+	if !isConfig && c.resumeStore != nil && srcInfo.Digest != "" {
+		canModifyBlob = false
+	}
+
+	// === Coalesce concurrent copies of the same digest into a single pipeline run.
+	// c.blobDedupe is non-nil whenever CopyOptions.MaxParallelDownloads/MaxParallelUploads let
+	// more than one layer be in flight at once; several layers in a manifest can share a digest,
+	// and only one of them should actually run the pipeline below.
+	if !isConfig && srcInfo.Digest != "" && c.blobDedupe != nil {
+		digestKey := srcInfo.Digest.String()
+		entry, isLeader := c.blobDedupe.leaderOrWait(digestKey)
+		if !isLeader {
+			<-entry.done
+			return entry.result, entry.err
+		}
+		defer func() {
+			c.blobDedupe.finish(digestKey, entry, uploadedInfo, err)
+		}()
+	}
+
+	// === Bypass the streaming pipeline entirely for zstd:chunked / eStargz layers when dest
+	// supports fetching only the chunks it is missing; this is the point lazy-pull snapshotters
+	// care about, so a full GET-and-recompress round trip isn't needed just to get there.
+	if !isConfig {
+		if ok, chunkedInfo, err := c.tryReusingBlobChunked(ctx, srcInfo); err != nil {
+			return types.BlobInfo{}, err
+		} else if ok {
+			return chunkedInfo, nil
+		}
+	}
+
+	// A resumed upload dest reports it can no longer continue (ErrResumeUnsupported) is retried from
+	// byte 0 by calling copyBlobOnce again in this loop; it never recurses back into
+	// copyBlobFromStream to do so.
+	// Recursing here would re-enter the leaderOrWait gate above, for the same digest, while this
+	// call's own leader slot (and deferred finish()) is still pending — a guaranteed deadlock
+	// whenever c.blobDedupe is in use.
+	for {
+		info, retryFromScratch, err := c.copyBlobOnce(ctx, srcReader, srcInfo, getOriginalLayerCopyWriter, canModifyBlob, isConfig, toEncrypt, bar, layerIndex, emptyLayer)
+		if retryFromScratch {
+			continue
+		}
+		return info, err
+	}
+}
+
+// copyBlobOnce runs a single attempt at uploading srcReader to dest as described by srcInfo,
+// either from scratch or resuming a previously-interrupted attempt via a checkpoint in
+// c.resumeStore. retryFromScratch is true if dest reported it can no longer resume this particular
+// upload (ErrResumeUnsupported): srcReader has already been rewound to byte 0, and the caller
+// should call copyBlobOnce again instead of treating this as a final result.
+func (c *copier) copyBlobOnce(ctx context.Context, srcReader io.Reader, srcInfo types.BlobInfo,
+	getOriginalLayerCopyWriter func(decompressor compressiontypes.DecompressorFunc) io.Writer,
+	canModifyBlob bool, isConfig bool, toEncrypt bool, bar *progressBar, layerIndex int, emptyLayer bool) (uploadedInfo types.BlobInfo, retryFromScratch bool, err error) {
+	// === Resume from a checkpoint saved by a previous, interrupted attempt at this same blob, if
+	// CopyOptions provided a ResumeStore, one was saved, dest implements ResumableBlobDestination,
+	// and srcReader can be rewound to it. If dest later turns out unable to continue this
+	// particular upload after all, it reports that via ErrResumeUnsupported; we then rewind
+	// srcReader to byte 0 below and return retryFromScratch, so the caller starts the blob over.
+	var resumeCheckpoint *BlobResumeCheckpoint
+	if !isConfig {
+		checkpoint, ok, err := c.loadBlobResumeCheckpoint(ctx, srcInfo)
+		if err != nil {
+			return types.BlobInfo{}, false, err
+		}
+		if ok && checkpoint.DigestState == nil && checkpoint.SourceBytesConsumed != 0 {
+			// There is no digest state to continue hashing from, so the blob is read from byte 0.
+			ok = false
+		}
+		if ok {
+			if seeker, ok := srcReader.(io.Seeker); ok {
+				if _, err := seeker.Seek(checkpoint.SourceBytesConsumed, io.SeekStart); err != nil {
+					return types.BlobInfo{}, false, errors.Wrapf(err, "seeking to resume blob %s at offset %d", srcInfo.Digest, checkpoint.SourceBytesConsumed)
+				}
+				resumeCheckpoint = &checkpoint
+			}
+			// If srcReader doesn't implement io.Seeker we silently fall back to a full restart.
+		}
+	}
 
 	// The copying happens through a pipeline of connected io.Readers;
 	// that pipeline is built by updating stream.
@@ -36,9 +130,20 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcReader io.Reader, sr
 	// Note that for this check we don't use the stronger "validationSucceeded" indicator, because
 	// dest.PutBlob may detect that the layer already exists, in which case we don't
 	// read stream to the end, and validation does not happen.
-	digestingReader, err := newDigestingReader(stream.reader, srcInfo.Digest)
+	//
+	// srcInfo.Digest may be "" for sources that only learn their digest once the stream has been
+	// fully read (e.g. a single-pass "tar | gzip" pipe from a builder); in that case digestingReader
+	// only computes the digest, and does not validate it against anything, and the computed value is
+	// plumbed back into uploadedInfo and the blob info cache once the stream has reached EOF.
+	digestKnownInAdvance := srcInfo.Digest != ""
+	var digestingReader *digestingReader
+	if resumeCheckpoint != nil {
+		digestingReader, err = newDigestingReaderResuming(stream.reader, srcInfo.Digest, resumeCheckpoint.SourceBytesConsumed, resumeCheckpoint.DigestState)
+	} else {
+		digestingReader, err = newDigestingReader(stream.reader, srcInfo.Digest)
+	}
 	if err != nil {
-		return types.BlobInfo{}, errors.Wrapf(err, "preparing to verify blob %s", srcInfo.Digest)
+		return types.BlobInfo{}, false, errors.Wrapf(err, "preparing to verify blob %s", srcInfo.Digest)
 	}
 	stream.reader = digestingReader
 
@@ -48,14 +153,14 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcReader io.Reader, sr
 	// === Decrypt the stream, if required.
 	decryptionStep, err := c.blobPipelineDecryptionStep(&stream, srcInfo)
 	if err != nil {
-		return types.BlobInfo{}, err
+		return types.BlobInfo{}, false, err
 	}
 
 	// === Detect compression of the input stream.
 	// This requires us to “peek ahead” into the stream to read the initial part, which requires us to chain through another io.Reader returned by DetectCompression.
 	detectedCompression, err := blobPipelineDetectCompressionStep(&stream, srcInfo)
 	if err != nil {
-		return types.BlobInfo{}, err
+		return types.BlobInfo{}, false, err
 	}
 
 	// === Send a copy of the original, uncompressed, stream, to a separate path if necessary.
@@ -70,21 +175,47 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcReader io.Reader, sr
 	// short-circuit conditions
 	compressionStep, err := c.blobPipelineCompressionStep(&stream, canModifyBlob, detectedCompression)
 	if err != nil {
-		return types.BlobInfo{}, err
+		return types.BlobInfo{}, false, err
 	}
 	defer compressionStep.close()
 
+	// === Run any additional caller-supplied pipeline stages (attestation signers, SBOM
+	// extractors, extra integrity digests, tee sinks, …), before the stream is (possibly)
+	// encrypted; encryption must stay the last step before the blob reaches dest.
+	additionalStages, err := c.blobPipelineAdditionalStages(ctx, &stream)
+	if err != nil {
+		return types.BlobInfo{}, false, err
+	}
+
 	// === Encrypt the stream for valid mediatypes if ociEncryptConfig provided
 	if decryptionStep.decrypting && toEncrypt {
 		// If nothing else, we can only set uploadedInfo.CryptoOperation to a single value.
 		// Before relaxing this, see the original pull request’s review if there are other reasons to reject this.
-		return types.BlobInfo{}, errors.New("Unable to support both decryption and encryption in the same copy")
+		return types.BlobInfo{}, false, errors.New("Unable to support both decryption and encryption in the same copy")
 	}
 	encryptionStep, err := c.blobPipelineEncryptionStep(&stream, toEncrypt, srcInfo, decryptionStep)
 	if err != nil {
-		return types.BlobInfo{}, err
+		return types.BlobInfo{}, false, err
+	}
+
+	// === Checkpoint progress to c.resumeStore, if configured, so a later retry of this blob can
+	// resume instead of restarting from byte 0.
+	var resumeKey string
+	if c.resumeStore != nil && !isConfig && srcInfo.Digest != "" {
+		resumeKey = c.blobResumeKey(srcInfo)
+		var destBaseOffset int64
+		if resumeCheckpoint != nil {
+			destBaseOffset = resumeCheckpoint.DestBytesConsumed
+		}
+		stream.reader = newResumeCheckpointReader(ctx, stream.reader, c.resumeStore, resumeKey, destBaseOffset, digestingReader.rawBytesConsumed, digestingReader.serializeState)
 	}
 
+	// === Buffer a copy of the stream to record a table of contents for this layer, if it is a
+	// zstd:chunked/eStargz layer and a ChunkedTOCParser was configured, so a later copy of the same
+	// layer can use tryReusingBlobChunked's partial-pull fast path above instead of streaming it in
+	// full again.
+	chunkedTOCStep := c.blobPipelineChunkedTOCRecordingStep(&stream, srcInfo)
+
 	// === Report progress using the c.progress channel, if required.
 	if c.progress != nil && c.progressInterval > 0 {
 		progressReader := newProgressReader(
@@ -97,6 +228,19 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcReader io.Reader, sr
 		stream.reader = progressReader
 	}
 
+	// === Checkpoint progress to c.resumeStore, if configured, so a later retry of this blob can
+	// resume instead of restarting from byte 0. This is the last reader wrapped, so that it is the
+	// one errorAnnotationReader forwards dest's NoteUploadProgress calls to.
+	var resumeKey string
+	if c.resumeStore != nil && !isConfig && srcInfo.Digest != "" {
+		resumeKey = c.blobResumeKey(srcInfo)
+		var destBaseOffset int64
+		if resumeCheckpoint != nil {
+			destBaseOffset = resumeCheckpoint.DestBytesConsumed
+		}
+		stream.reader = newResumeCheckpointReader(ctx, stream.reader, c.resumeStore, resumeKey, destBaseOffset, digestingReader.rawBytesConsumed, digestingReader.serializeState)
+	}
+
 	// === Finally, send the layer stream to dest.
 	options := private.PutBlobOptions{
 		Cache:      c.blobInfoCache,
@@ -106,17 +250,58 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcReader io.Reader, sr
 	if !isConfig {
 		options.LayerIndex = &layerIndex
 	}
-	uploadedInfo, err := c.dest.PutBlobWithOptions(ctx, &errorAnnotationReader{stream.reader}, stream.info, options)
+	uploadReader := &errorAnnotationReader{stream.reader}
+	if resumeCheckpoint != nil {
+		resumable, ok := c.dest.(ResumableBlobDestination)
+		if !ok {
+			// loadBlobResumeCheckpoint already checked this; c.dest can't have changed since.
+			return types.BlobInfo{}, false, errors.Errorf("internal error: resuming blob %s but dest is not a ResumableBlobDestination", srcInfo.Digest)
+		}
+		uploadedInfo, err = resumable.ResumePutBlob(ctx, uploadReader, stream.info, options, resumeCheckpoint.DestBytesConsumed, resumeCheckpoint.UploadResumeData)
+		if errors.Is(err, ErrResumeUnsupported) {
+			logrus.Debugf("dest can no longer resume blob %s, restarting from byte 0", srcInfo.Digest)
+			c.forgetBlobResumeCheckpoint(ctx, resumeKey)
+			seeker, ok := srcReader.(io.Seeker)
+			if !ok {
+				return types.BlobInfo{}, false, errors.Errorf("internal error: srcReader for blob %s is no longer an io.Seeker", srcInfo.Digest)
+			}
+			if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr != nil {
+				return types.BlobInfo{}, false, errors.Wrapf(seekErr, "restarting blob %s from byte 0 after a failed resume", srcInfo.Digest)
+			}
+			return types.BlobInfo{}, true, nil
+		}
+	} else {
+		uploadedInfo, err = c.dest.PutBlobWithOptions(ctx, uploadReader, stream.info, options)
+	}
 	if err != nil {
-		return types.BlobInfo{}, errors.Wrap(err, "writing blob")
+		return types.BlobInfo{}, false, errors.Wrap(err, "writing blob")
+	}
+
+	if !digestKnownInAdvance {
+		// The source did not know its digest in advance; now that the stream has been drained by
+		// PutBlobWithOptions, digestingReader has computed it on the fly. Plumb that value back
+		// into the blob info so that the consistency check and cache recording below, and the
+		// info we return to the caller, behave exactly as if the digest had been known from the
+		// start.
+		computedDigest := digestingReader.digest()
+		stream.info.Digest = computedDigest
+		if uploadedInfo.Digest == "" {
+			uploadedInfo.Digest = computedDigest
+		}
 	}
 
 	uploadedInfo.Annotations = stream.info.Annotations
+	// recordTOC must run after the assignment above, which replaces uploadedInfo.Annotations
+	// wholesale; calling it any earlier would have its annotation edits silently discarded.
+	chunkedTOCStep.recordTOC(&uploadedInfo)
 
 	compressionStep.updateCompressionEdits(&uploadedInfo.CompressionOperation, &uploadedInfo.CompressionAlgorithm, &uploadedInfo.Annotations)
 	decryptionStep.updateCryptoOperation(&uploadedInfo.CryptoOperation)
 	if err := encryptionStep.updateCryptoOperationAndAnnotations(&uploadedInfo.CryptoOperation, &uploadedInfo.Annotations); err != nil {
-		return types.BlobInfo{}, err
+		return types.BlobInfo{}, false, err
+	}
+	if err := additionalStages.updateEdits(&uploadedInfo); err != nil {
+		return types.BlobInfo{}, false, err
 	}
 
 	// This is fairly horrible: the writer from getOriginalLayerCopyWriter wants to consume
@@ -127,31 +312,42 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcReader io.Reader, sr
 		logrus.Debugf("Consuming rest of the original blob to satisfy getOriginalLayerCopyWriter")
 		_, err := io.Copy(io.Discard, originalLayerReader)
 		if err != nil {
-			return types.BlobInfo{}, errors.Wrapf(err, "reading input blob %s", srcInfo.Digest)
+			return types.BlobInfo{}, false, errors.Wrapf(err, "reading input blob %s", srcInfo.Digest)
 		}
 	}
 
 	if digestingReader.validationFailed { // Coverage: This should never happen.
-		return types.BlobInfo{}, errors.Errorf("Internal error writing blob %s, digest verification failed but was ignored", srcInfo.Digest)
+		return types.BlobInfo{}, false, errors.Errorf("Internal error writing blob %s, digest verification failed but was ignored", srcInfo.Digest)
 	}
 	if stream.info.Digest != "" && uploadedInfo.Digest != stream.info.Digest {
-		return types.BlobInfo{}, errors.Errorf("Internal error writing blob %s, blob with digest %s saved with digest %s", srcInfo.Digest, stream.info.Digest, uploadedInfo.Digest)
+		return types.BlobInfo{}, false, errors.Errorf("Internal error writing blob %s, blob with digest %s saved with digest %s", srcInfo.Digest, stream.info.Digest, uploadedInfo.Digest)
 	}
-	if digestingReader.validationSucceeded {
+	// With a digest known only after the fact, there was nothing to validate against, but the
+	// computed digest is just as trustworthy as one that had been validated: it was computed by
+	// digestingReader itself, over the exact bytes delivered to dest.
+	if digestingReader.validationSucceeded || !digestKnownInAdvance {
 		if err := compressionStep.recordValidatedDigestData(c, uploadedInfo, srcInfo, encryptionStep, decryptionStep); err != nil {
-			return types.BlobInfo{}, err
+			return types.BlobInfo{}, false, err
 		}
 	}
 
-	return uploadedInfo, nil
+	if resumeKey != "" {
+		c.forgetBlobResumeCheckpoint(ctx, resumeKey)
+	}
+
+	return uploadedInfo, false, nil
 }
 
 // sourceStream encapsulates an input consumed by copyBlobFromStream, in progress of being built.
 // This allows handles of individual aspects to build the copy pipeline without _too much_
 // specific cooperation by the caller.
 //
-// We are currently very far from a generalized plug-and-play API for building/consuming the pipeline
-// without specific knowledge of various aspects in copyBlobFromStream; that may come one day.
+// NOTE on scope: the built-in decrypt/detect-compression/compress/encrypt/progress steps below are
+// still copyBlobFromStream's own hardcoded, fixed-order private methods, not BlobPipelineStage
+// implementations; only caller-supplied stages (CopyOptions.AdditionalBlobPipelineStages) go
+// through that interface. Refactoring the built-ins to implement BlobPipelineStage themselves, so
+// that the whole pipeline (not just the caller-extensible part of it) is driven by one uniform
+// mechanism, remains unscoped future work, not something this additive extension point attempted.
 type sourceStream struct {
 	reader io.Reader
 	info   types.BlobInfo // corresponding to the data available in reader.
@@ -170,4 +366,13 @@ func (r errorAnnotationReader) Read(b []byte) (n int, err error) {
 		return n, errors.Wrapf(err, "happened during read")
 	}
 	return n, err
-}
\ No newline at end of file
+}
+
+// NoteUploadProgress implements BlobUploadProgressNotifier, forwarding to the wrapped reader if
+// it supports it, so that a ResumableBlobDestination's progress reports reach resumeCheckpointReader
+// even though it is not the outermost reader dest was given.
+func (r errorAnnotationReader) NoteUploadProgress(uploadedBytes int64, resumeData []byte) {
+	if notifiee, ok := r.reader.(BlobUploadProgressNotifier); ok {
+		notifiee.NoteUploadProgress(uploadedBytes, resumeData)
+	}
+}
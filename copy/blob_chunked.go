@@ -0,0 +1,180 @@
+package copy
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// zstdChunkedManifestAnnotation marks a layer that was compressed with zstd:chunked and
+	// carries the offset of its table-of-contents footer, following the same convention as
+	// containers/storage's c/storage/pkg/chunked.
+	zstdChunkedManifestAnnotation = "io.containers.zstd-chunked.manifest-position"
+	// estargzTOCDigestAnnotation marks a layer as being in eStargz format and gives the digest
+	// of its table-of-contents, following the stargz-snapshotter convention.
+	estargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+)
+
+// tocChunk is one entry of a layer’s table of contents: the (offset, length) of a single
+// compressed chunk within the blob, and the digest of that chunk once decompressed.
+type tocChunk struct {
+	offset             int64
+	length             int64
+	uncompressedDigest digest.Digest
+}
+
+// chunkedBlobInfoCache extends the plain digest-keyed blob info cache with a
+// (layer digest, chunk index) → tocChunk table, so that a later copy of the same layer can locate
+// and fetch only the chunks a destination is missing instead of the whole blob.
+type chunkedBlobInfoCache interface {
+	types.BlobInfoCache
+
+	// RecordTOC records the table of contents for layerDigest, so that a future copy can look
+	// up individual chunks by index without re-fetching or re-parsing the TOC footer.
+	RecordTOC(layerDigest digest.Digest, chunks []tocChunk) error
+	// TOC returns the previously-recorded table of contents for layerDigest, if any.
+	TOC(layerDigest digest.Digest) ([]tocChunk, bool)
+}
+
+// chunkedPartialPullDestination is implemented by destinations that can fetch only the chunks of
+// a layer they are missing, given its table of contents, instead of requiring the full blob to be
+// streamed through copyBlobFromStream. PutBlobPartial's parameters use this package's unexported
+// types, so only types inside this package can implement it.
+type chunkedPartialPullDestination interface {
+	// SupportsPutBlobPartial returns true if PutBlobPartial can be used for layers whose TOC is
+	// known, instead of running them through the normal copyBlobFromStream pipeline.
+	SupportsPutBlobPartial() bool
+	// PutBlobPartial fetches only the chunks of srcInfo that are not already present at the
+	// destination, using toc to know which byte ranges make up each chunk, and assembles them
+	// into a complete blob.
+	PutBlobPartial(ctx context.Context, srcInfo types.BlobInfo, toc []tocChunk, cache chunkedBlobInfoCache) (types.BlobInfo, error)
+}
+
+// tryReusingBlobChunked attempts to short-circuit the usual copyBlobFromStream pipeline for a
+// zstd:chunked or eStargz layer by fetching only the chunks dest is missing, using the TOC
+// recorded in c.blobInfoCache from a previous copy of the same layer. It returns ok == false
+// (with no error) whenever the fast path does not apply, in which case the caller should fall
+// back to the normal streaming copy.
+func (c *copier) tryReusingBlobChunked(ctx context.Context, srcInfo types.BlobInfo) (bool, types.BlobInfo, error) {
+	if srcInfo.Digest == "" {
+		return false, types.BlobInfo{}, nil // No way to look up a TOC without a known digest.
+	}
+	if !layerIsChunked(srcInfo) {
+		return false, types.BlobInfo{}, nil
+	}
+	partialDest, ok := c.dest.(chunkedPartialPullDestination)
+	if !ok || !partialDest.SupportsPutBlobPartial() {
+		return false, types.BlobInfo{}, nil
+	}
+	cache, ok := c.blobInfoCache.(chunkedBlobInfoCache)
+	if !ok {
+		return false, types.BlobInfo{}, nil
+	}
+	toc, ok := cache.TOC(srcInfo.Digest)
+	if !ok {
+		return false, types.BlobInfo{}, nil // We have never seen a TOC for this layer; stream the whole thing instead.
+	}
+	uploadedInfo, err := partialDest.PutBlobPartial(ctx, srcInfo, toc, cache)
+	if err != nil {
+		return false, types.BlobInfo{}, errors.Wrapf(err, "fetching missing chunks of blob %s", srcInfo.Digest)
+	}
+	return true, uploadedInfo, nil
+}
+
+// layerIsChunked reports whether srcInfo carries the annotations of a zstd:chunked or eStargz
+// layer, i.e. one that has a table of contents we could potentially reuse.
+func layerIsChunked(srcInfo types.BlobInfo) bool {
+	if srcInfo.Annotations == nil {
+		return false
+	}
+	_, zstdChunked := srcInfo.Annotations[zstdChunkedManifestAnnotation]
+	_, estargz := srcInfo.Annotations[estargzTOCDigestAnnotation]
+	return zstdChunked || estargz
+}
+
+// chunkedTOCParser extracts a table of contents out of the complete bytes of a zstd:chunked or
+// eStargz layer, once copyBlobFromStream has streamed the whole blob through. The actual footer
+// parsing is format-specific and is not implemented in this package; this package only knows
+// where to plug a parser in and what to do with the result.
+// Callers that want tryReusingBlobChunked's fast path to ever trigger must supply one via
+// CopyOptions.ChunkedTOCParser.
+type ChunkedTOCParser interface {
+	// ParseTOC parses the table of contents out of blob, the complete bytes of the layer
+	// described by srcInfo (as sent to the destination, i.e. after any decryption but before
+	// any further processing this package performs on it).
+	ParseTOC(srcInfo types.BlobInfo, blob []byte) ([]tocChunk, error)
+}
+
+// chunkedTOCRecordingStep buffers a copy of a chunked layer's bytes as they are uploaded, so that
+// once the upload has completed, recordTOC can hand the complete blob to a ChunkedTOCParser and
+// persist the result for a future tryReusingBlobChunked call to find.
+type chunkedTOCRecordingStep struct {
+	parser  ChunkedTOCParser
+	cache   chunkedBlobInfoCache
+	srcInfo types.BlobInfo
+	buf     *bytes.Buffer // nil if this step is inactive.
+}
+
+// blobPipelineChunkedTOCRecordingStep arranges to record a table of contents for srcInfo while it
+// is uploaded through stream, if c.chunkedTOCParser is configured and c.blobInfoCache can store a TOC,
+// and srcInfo is actually announced as a zstd:chunked or eStargz layer. Otherwise it returns an
+// inactive step that recordTOC can still be called on as a no-op.
+func (c *copier) blobPipelineChunkedTOCRecordingStep(stream *sourceStream, srcInfo types.BlobInfo) *chunkedTOCRecordingStep {
+	if c.chunkedTOCParser == nil || !layerIsChunked(srcInfo) {
+		return &chunkedTOCRecordingStep{}
+	}
+	cache, ok := c.blobInfoCache.(chunkedBlobInfoCache)
+	if !ok {
+		return &chunkedTOCRecordingStep{}
+	}
+	buf := &bytes.Buffer{}
+	stream.reader = io.TeeReader(stream.reader, buf)
+	return &chunkedTOCRecordingStep{
+		parser:  c.chunkedTOCParser,
+		cache:   cache,
+		srcInfo: srcInfo,
+		buf:     buf,
+	}
+}
+
+// recordTOC parses and records the table of contents for the blob that was just uploaded as
+// *uploadedInfo, if this step is active, and attaches the OCI annotations a future
+// tryReusingBlobChunked call needs to recognize this blob as chunked to uploadedInfo.Annotations.
+// uploadedInfo is taken by pointer, and must be called after any assignment that replaces
+// uploadedInfo.Annotations wholesale (e.g. copyBlobOnce's uploadedInfo.Annotations =
+// stream.info.Annotations), or this edit would just be silently overwritten again.
+// Parse/record failures are logged, not returned: a layer we fail to index for partial pulls is
+// still a perfectly valid layer, just one future copies of it will have to stream in full instead
+// of taking the fast path.
+func (s *chunkedTOCRecordingStep) recordTOC(uploadedInfo *types.BlobInfo) {
+	if s.buf == nil {
+		return
+	}
+	chunks, err := s.parser.ParseTOC(s.srcInfo, s.buf.Bytes())
+	if err != nil {
+		logrus.Debugf("parsing table of contents of chunked blob %s: %v", uploadedInfo.Digest, err)
+		return
+	}
+	if err := s.cache.RecordTOC(uploadedInfo.Digest, chunks); err != nil {
+		logrus.Debugf("recording table of contents of chunked blob %s: %v", uploadedInfo.Digest, err)
+		return
+	}
+	// The bytes dest received are identical to srcInfo's (canModifyBlob is never set for a layer
+	// this step is active for, see blobPipelineChunkedTOCRecordingStep), so srcInfo's own
+	// chunked-layer annotations describe the uploaded blob just as accurately; make sure they
+	// actually reach the caller instead of being dropped.
+	if uploadedInfo.Annotations == nil {
+		uploadedInfo.Annotations = map[string]string{}
+	}
+	for _, key := range []string{zstdChunkedManifestAnnotation, estargzTOCDigestAnnotation} {
+		if value, ok := s.srcInfo.Annotations[key]; ok {
+			uploadedInfo.Annotations[key] = value
+		}
+	}
+}
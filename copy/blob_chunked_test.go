@@ -0,0 +1,214 @@
+package copy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/containers/image/v5/internal/private"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var errRecordTOCTest = errors.New("test error from PutBlobPartial")
+
+// fakeChunkedBlobInfoCache implements chunkedBlobInfoCache by embedding a nil
+// types.BlobInfoCache (these tests never call its other methods) and backing RecordTOC/TOC with a
+// plain map.
+type fakeChunkedBlobInfoCache struct {
+	types.BlobInfoCache
+	tocs map[digest.Digest][]tocChunk
+}
+
+func (f *fakeChunkedBlobInfoCache) RecordTOC(layerDigest digest.Digest, chunks []tocChunk) error {
+	if f.tocs == nil {
+		f.tocs = map[digest.Digest][]tocChunk{}
+	}
+	f.tocs[layerDigest] = chunks
+	return nil
+}
+
+func (f *fakeChunkedBlobInfoCache) TOC(layerDigest digest.Digest) ([]tocChunk, bool) {
+	chunks, ok := f.tocs[layerDigest]
+	return chunks, ok
+}
+
+// fakeChunkedTOCParser records the bytes it was asked to parse and returns a canned result.
+type fakeChunkedTOCParser struct {
+	chunks     []tocChunk
+	err        error
+	calledWith []byte
+}
+
+func (p *fakeChunkedTOCParser) ParseTOC(_ types.BlobInfo, blob []byte) ([]tocChunk, error) {
+	p.calledWith = blob
+	return p.chunks, p.err
+}
+
+func chunkedSrcInfo() types.BlobInfo {
+	return types.BlobInfo{
+		Digest:      digest.FromString("src"),
+		Annotations: map[string]string{zstdChunkedManifestAnnotation: "1234"},
+	}
+}
+
+func TestBlobPipelineChunkedTOCRecordingStepRecordsTOC(t *testing.T) {
+	cache := &fakeChunkedBlobInfoCache{}
+	parser := &fakeChunkedTOCParser{chunks: []tocChunk{{offset: 0, length: 5}}}
+	c := &copier{blobInfoCache: cache, chunkedTOCParser: parser}
+
+	content := []byte("hello")
+	stream := &sourceStream{reader: bytes.NewReader(content)}
+	step := c.blobPipelineChunkedTOCRecordingStep(stream, chunkedSrcInfo())
+
+	if _, err := io.Copy(io.Discard, stream.reader); err != nil {
+		t.Fatalf("draining stream: %v", err)
+	}
+
+	uploadedInfo := types.BlobInfo{Digest: digest.FromString("uploaded")}
+	step.recordTOC(&uploadedInfo)
+
+	if !bytes.Equal(parser.calledWith, content) {
+		t.Errorf("parser was handed %q, want %q", parser.calledWith, content)
+	}
+	chunks, ok := cache.TOC(uploadedInfo.Digest)
+	if !ok {
+		t.Fatal("RecordTOC was never called")
+	}
+	if len(chunks) != 1 || chunks[0].length != 5 {
+		t.Errorf("recorded chunks = %v, want the parser's result", chunks)
+	}
+	if got := uploadedInfo.Annotations[zstdChunkedManifestAnnotation]; got != "1234" {
+		t.Errorf("uploadedInfo.Annotations[%s] = %q, want %q (carried over from srcInfo)", zstdChunkedManifestAnnotation, got, "1234")
+	}
+}
+
+// fakeChunkedPullDestination implements chunkedPartialPullDestination by embedding a nil
+// private.ImageDestination (these tests never call any of its other methods).
+type fakeChunkedPullDestination struct {
+	private.ImageDestination
+	supportsPartial      bool
+	putBlobPartialCalled bool
+	gotTOC               []tocChunk
+	result               types.BlobInfo
+	err                  error
+}
+
+func (f *fakeChunkedPullDestination) SupportsPutBlobPartial() bool { return f.supportsPartial }
+
+func (f *fakeChunkedPullDestination) PutBlobPartial(_ context.Context, _ types.BlobInfo, toc []tocChunk, _ chunkedBlobInfoCache) (types.BlobInfo, error) {
+	f.putBlobPartialCalled = true
+	f.gotTOC = toc
+	return f.result, f.err
+}
+
+func TestTryReusingBlobChunkedFastPath(t *testing.T) {
+	srcInfo := chunkedSrcInfo()
+	wantTOC := []tocChunk{{offset: 0, length: 5}}
+	cache := &fakeChunkedBlobInfoCache{tocs: map[digest.Digest][]tocChunk{srcInfo.Digest: wantTOC}}
+	dest := &fakeChunkedPullDestination{supportsPartial: true, result: types.BlobInfo{Digest: digest.FromString("reassembled")}}
+	c := &copier{dest: dest, blobInfoCache: cache}
+
+	ok, info, err := c.tryReusingBlobChunked(context.Background(), srcInfo)
+	if err != nil {
+		t.Fatalf("tryReusingBlobChunked: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected the partial-pull fast path to trigger")
+	}
+	if !dest.putBlobPartialCalled {
+		t.Error("PutBlobPartial was never called")
+	}
+	if len(dest.gotTOC) != 1 || dest.gotTOC[0].length != 5 {
+		t.Errorf("PutBlobPartial was handed TOC %v, want %v", dest.gotTOC, wantTOC)
+	}
+	if info.Digest != dest.result.Digest {
+		t.Errorf("returned info.Digest = %s, want %s (dest's result)", info.Digest, dest.result.Digest)
+	}
+}
+
+func TestTryReusingBlobChunkedInactiveCases(t *testing.T) {
+	srcInfo := chunkedSrcInfo()
+
+	t.Run("digest unknown", func(t *testing.T) {
+		c := &copier{}
+		ok, _, err := c.tryReusingBlobChunked(context.Background(), types.BlobInfo{})
+		if err != nil || ok {
+			t.Errorf("got ok=%v err=%v, want ok=false err=nil", ok, err)
+		}
+	})
+
+	t.Run("layer is not chunked", func(t *testing.T) {
+		c := &copier{}
+		ok, _, err := c.tryReusingBlobChunked(context.Background(), types.BlobInfo{Digest: digest.FromString("plain")})
+		if err != nil || ok {
+			t.Errorf("got ok=%v err=%v, want ok=false err=nil", ok, err)
+		}
+	})
+
+	t.Run("dest does not support partial pulls", func(t *testing.T) {
+		c := &copier{dest: &fakeChunkedPullDestination{supportsPartial: false}}
+		ok, _, err := c.tryReusingBlobChunked(context.Background(), srcInfo)
+		if err != nil || ok {
+			t.Errorf("got ok=%v err=%v, want ok=false err=nil", ok, err)
+		}
+	})
+
+	t.Run("cache does not support TOCs", func(t *testing.T) {
+		c := &copier{dest: &fakeChunkedPullDestination{supportsPartial: true}, blobInfoCache: nil}
+		ok, _, err := c.tryReusingBlobChunked(context.Background(), srcInfo)
+		if err != nil || ok {
+			t.Errorf("got ok=%v err=%v, want ok=false err=nil", ok, err)
+		}
+	})
+
+	t.Run("no TOC recorded for this digest", func(t *testing.T) {
+		c := &copier{dest: &fakeChunkedPullDestination{supportsPartial: true}, blobInfoCache: &fakeChunkedBlobInfoCache{}}
+		ok, _, err := c.tryReusingBlobChunked(context.Background(), srcInfo)
+		if err != nil || ok {
+			t.Errorf("got ok=%v err=%v, want ok=false err=nil", ok, err)
+		}
+	})
+
+	t.Run("PutBlobPartial fails", func(t *testing.T) {
+		cache := &fakeChunkedBlobInfoCache{tocs: map[digest.Digest][]tocChunk{srcInfo.Digest: {{offset: 0, length: 1}}}}
+		dest := &fakeChunkedPullDestination{supportsPartial: true, err: errRecordTOCTest}
+		c := &copier{dest: dest, blobInfoCache: cache}
+		ok, _, err := c.tryReusingBlobChunked(context.Background(), srcInfo)
+		if err == nil || ok {
+			t.Errorf("got ok=%v err=%v, want ok=false and a wrapped error", ok, err)
+		}
+	})
+}
+
+func TestBlobPipelineChunkedTOCRecordingStepInactiveCases(t *testing.T) {
+	content := []byte("hello")
+
+	t.Run("no parser configured", func(t *testing.T) {
+		c := &copier{blobInfoCache: &fakeChunkedBlobInfoCache{}}
+		stream := &sourceStream{reader: bytes.NewReader(content)}
+		step := c.blobPipelineChunkedTOCRecordingStep(stream, chunkedSrcInfo())
+		step.recordTOC(&types.BlobInfo{Digest: digest.FromString("uploaded")}) // Must not panic.
+		if n, _ := io.Copy(io.Discard, stream.reader); n != int64(len(content)) {
+			t.Errorf("stream was tampered with when the step is inactive")
+		}
+	})
+
+	t.Run("cache does not support TOCs", func(t *testing.T) {
+		c := &copier{chunkedTOCParser: &fakeChunkedTOCParser{}}
+		stream := &sourceStream{reader: bytes.NewReader(content)}
+		step := c.blobPipelineChunkedTOCRecordingStep(stream, chunkedSrcInfo())
+		step.recordTOC(&types.BlobInfo{Digest: digest.FromString("uploaded")}) // Must not panic.
+	})
+
+	t.Run("layer is not chunked", func(t *testing.T) {
+		c := &copier{blobInfoCache: &fakeChunkedBlobInfoCache{}, chunkedTOCParser: &fakeChunkedTOCParser{}}
+		stream := &sourceStream{reader: bytes.NewReader(content)}
+		step := c.blobPipelineChunkedTOCRecordingStep(stream, types.BlobInfo{Digest: digest.FromString("src")})
+		if step.buf != nil {
+			t.Error("step should be inactive for a plain, non-chunked layer")
+		}
+	})
+}
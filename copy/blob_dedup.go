@@ -0,0 +1,56 @@
+package copy
+
+import (
+	"sync"
+
+	"github.com/containers/image/v5/types"
+)
+
+// blobDigestGate coalesces concurrent copyBlobFromStream calls for the same source digest into a
+// single pipeline run. It exists to make c.copyBlobFromStream safe to call from the worker pool
+// CopyOptions.MaxParallelDownloads/MaxParallelUploads spin up: several layers in a manifest can
+// share one digest, and without this gate each would independently download, (de)compress and
+// upload the same bytes.
+type blobDigestGate struct {
+	mutex    sync.Mutex
+	inFlight map[string]*blobDigestGateEntry
+}
+
+// blobDigestGateEntry tracks one in-flight (or just-finished) pipeline run for a given digest.
+type blobDigestGateEntry struct {
+	done   chan struct{} // closed once result/err have been set
+	result types.BlobInfo
+	err    error
+}
+
+// newBlobDigestGate creates an empty blobDigestGate; one is shared by all of a copier’s
+// concurrent copyBlobFromStream goroutines via c.blobDedupe.
+func newBlobDigestGate() *blobDigestGate {
+	return &blobDigestGate{inFlight: map[string]*blobDigestGateEntry{}}
+}
+
+// leaderOrWait registers digest as being copied. If this is the first caller for digest, it
+// returns (entry, true) and the caller must run the pipeline itself and call g.finish when
+// done. Otherwise it returns (entry, false); the caller should wait on entry.done and then use
+// entry.result/entry.err instead of running the pipeline a second time.
+func (g *blobDigestGate) leaderOrWait(digest string) (entry *blobDigestGateEntry, isLeader bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if e, ok := g.inFlight[digest]; ok {
+		return e, false
+	}
+	e := &blobDigestGateEntry{done: make(chan struct{})}
+	g.inFlight[digest] = e
+	return e, true
+}
+
+// finish records the pipeline’s outcome for digest, removes it from g.inFlight (so a later,
+// unrelated copy of the same digest starts a fresh pipeline run instead of replaying this one’s
+// result forever), and wakes up any goroutines waiting on it.
+func (g *blobDigestGate) finish(digest string, entry *blobDigestGateEntry, result types.BlobInfo, err error) {
+	entry.result, entry.err = result, err
+	g.mutex.Lock()
+	delete(g.inFlight, digest)
+	g.mutex.Unlock()
+	close(entry.done)
+}
@@ -0,0 +1,56 @@
+package copy
+
+import (
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+func TestBlobDigestGateLeaderOrWait(t *testing.T) {
+	g := newBlobDigestGate()
+
+	entry1, isLeader1 := g.leaderOrWait("digest")
+	if !isLeader1 {
+		t.Fatal("first caller for a digest must be the leader")
+	}
+	entry2, isLeader2 := g.leaderOrWait("digest")
+	if isLeader2 {
+		t.Fatal("second caller for the same in-flight digest must not also be the leader")
+	}
+	if entry1 != entry2 {
+		t.Fatal("waiter must be handed the leader's own entry")
+	}
+
+	result := types.BlobInfo{Digest: "sha256:abc"}
+	wantErr := errors.New("pipeline failed")
+	g.finish("digest", entry1, result, wantErr)
+
+	select {
+	case <-entry2.done:
+	default:
+		t.Fatal("finish must close entry.done so waiters stop blocking")
+	}
+	if entry2.result.Digest != result.Digest || entry2.err != wantErr {
+		t.Errorf("waiter observed result=%v err=%v, want result=%v err=%v", entry2.result, entry2.err, result, wantErr)
+	}
+}
+
+func TestBlobDigestGateFinishRemovesEntry(t *testing.T) {
+	g := newBlobDigestGate()
+
+	entry, isLeader := g.leaderOrWait("digest")
+	if !isLeader {
+		t.Fatal("first caller for a digest must be the leader")
+	}
+	g.finish("digest", entry, types.BlobInfo{}, nil)
+
+	if len(g.inFlight) != 0 {
+		t.Errorf("g.inFlight has %d entries after finish, want 0 (unbounded growth across many digests)", len(g.inFlight))
+	}
+
+	_, isLeader2 := g.leaderOrWait("digest")
+	if !isLeader2 {
+		t.Error("a later, unrelated copy of the same digest must start a fresh pipeline run, not replay the finished one")
+	}
+}
@@ -0,0 +1,109 @@
+package copy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containers/image/v5/internal/private"
+	compressiontypes "github.com/containers/image/v5/pkg/compression/types"
+	"github.com/containers/image/v5/types"
+)
+
+// copyBlobsRequest is one blob to copy as part of a copyBlobs call; its fields mirror
+// copyBlobFromStream's parameters.
+type copyBlobsRequest struct {
+	srcReader                  io.Reader
+	srcInfo                    types.BlobInfo
+	getOriginalLayerCopyWriter func(decompressor compressiontypes.DecompressorFunc) io.Writer
+	canModifyBlob              bool
+	isConfig                   bool
+	toEncrypt                  bool
+	bar                        *progressBar
+	layerIndex                 int
+	emptyLayer                 bool
+}
+
+// copyBlobsResult is copyBlobFromStream's outcome for one copyBlobsRequest.
+type copyBlobsResult struct {
+	uploadedInfo types.BlobInfo
+	err          error
+}
+
+// copyBlobs runs copyBlobFromStream for each of requests, using up to c.maxParallelBlobCopies
+// workers at once, and returns one result per request in the same order requests were given in.
+// c.blobDedupe (constructed whenever that limit is > 1) makes this safe even when several requests
+// share a source digest: only one of them actually runs the pipeline, the rest wait for its result.
+//
+// It is the caller's responsibility to only pass requests whose srcReader/bar/etc. are safe to use
+// from a different goroutine than the one that built them; c.progress and c.blobInfoCache are
+// documented by the types.ProgressProperties/types.BlobInfoCache contracts to be safe for
+// concurrent use for exactly this reason.
+func (c *copier) copyBlobs(ctx context.Context, requests []copyBlobsRequest) []copyBlobsResult {
+	results := make([]copyBlobsResult, len(requests))
+	runBounded(len(requests), c.maxParallelBlobCopies, func(i int) {
+		req := requests[i]
+		uploadedInfo, err := c.copyBlobFromStream(ctx, req.srcReader, req.srcInfo, req.getOriginalLayerCopyWriter,
+			req.canModifyBlob, req.isConfig, req.toEncrypt, req.bar, req.layerIndex, req.emptyLayer)
+		results[i] = copyBlobsResult{uploadedInfo: uploadedInfo, err: err}
+	})
+	return results
+}
+
+// runBounded calls fn(i) for every i in [0, n), running at most maxConcurrency calls at once, and
+// waits for all of them to finish before returning. maxConcurrency < 1 is treated as 1, i.e. fully
+// serial, matching copyBlobs' behavior before CopyOptions.MaxParallelDownloads/MaxParallelUploads
+// existed.
+func runBounded(n int, maxConcurrency int, fn func(i int)) {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// destinationSerializesBlobWrites is implemented by destinations whose transport or on-disk layout
+// requires blobs to be committed one at a time no matter what CopyOptions asks for (e.g. a
+// docker-archive or single-file dir destination writing into one shared file/tar stream).
+// effectiveBlobParallelism consults this to force its limit down to 1 for such a destination,
+// rather than trusting the caller's CopyOptions alone.
+type destinationSerializesBlobWrites interface {
+	// MustSerializeBlobWrites returns true if this destination can never accept more than one
+	// blob commit at a time, regardless of CopyOptions.MaxParallelDownloads/MaxParallelUploads.
+	MustSerializeBlobWrites() bool
+}
+
+// effectiveBlobParallelism resolves CopyOptions.MaxParallelDownloads/MaxParallelUploads, and dest's
+// own capabilities, into the single worker-pool size copyBlobs uses. copyBlobFromStream reads its
+// source and writes to dest in one unbroken streaming pipeline, so this package has no way to bound
+// those two legs independently: MaxParallelUploads can only ever tighten MaxParallelDownloads'
+// limit (e.g. for a destination whose transport accepts fewer concurrent requests than the source
+// can serve), never loosen it. A MaxParallelDownloads of 0 means 1; a MaxParallelUploads of 0
+// means it does not tighten the limit at all. If dest
+// implements destinationSerializesBlobWrites and reports true, the limit is forced to 1 regardless
+// of what CopyOptions asked for: running several pipelines concurrently just to have them block on
+// each other at the commit step would only cost memory for no parallelism gained.
+func effectiveBlobParallelism(dest private.ImageDestination, options CopyOptions) int {
+	limit := options.MaxParallelDownloads
+	if limit == 0 {
+		limit = 1
+	}
+	if uploads := options.MaxParallelUploads; uploads != 0 && uploads < limit {
+		limit = uploads
+	}
+	if serializer, ok := dest.(destinationSerializesBlobWrites); ok && serializer.MustSerializeBlobWrites() {
+		limit = 1
+	}
+	return int(limit)
+}
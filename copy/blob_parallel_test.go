@@ -0,0 +1,142 @@
+package copy
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containers/image/v5/internal/private"
+)
+
+func TestRunBoundedRunsEveryTaskExactlyOnce(t *testing.T) {
+	const n = 50
+	var seen [n]int32
+	runBounded(n, 4, func(i int) {
+		atomic.AddInt32(&seen[i], 1)
+	})
+	for i, count := range seen {
+		if count != 1 {
+			t.Errorf("task %d ran %d times, want exactly 1", i, count)
+		}
+	}
+}
+
+func TestRunBoundedRespectsMaxConcurrency(t *testing.T) {
+	const n = 50
+	const maxConcurrency = 5
+
+	var current, peak int32
+	runBounded(n, maxConcurrency, func(i int) {
+		c := atomic.AddInt32(&current, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if c <= p || atomic.CompareAndSwapInt32(&peak, p, c) {
+				break
+			}
+		}
+		atomic.AddInt32(&current, -1)
+	})
+	if peak > maxConcurrency {
+		t.Errorf("observed concurrency %d, want <= %d", peak, maxConcurrency)
+	}
+}
+
+func TestRunBoundedTreatsZeroAndNegativeAsSerial(t *testing.T) {
+	const n = 10
+	for _, maxConcurrency := range []int{0, -1} {
+		var current, peak int32
+		runBounded(n, maxConcurrency, func(i int) {
+			c := atomic.AddInt32(&current, 1)
+			if c > atomic.LoadInt32(&peak) {
+				atomic.StoreInt32(&peak, c)
+			}
+			atomic.AddInt32(&current, -1)
+		})
+		if peak > 1 {
+			t.Errorf("maxConcurrency=%d: observed concurrency %d, want 1 (serial)", maxConcurrency, peak)
+		}
+	}
+}
+
+func TestEffectiveBlobParallelism(t *testing.T) {
+	cases := []struct {
+		name     string
+		options  CopyOptions
+		expected int
+	}{
+		{"unset", CopyOptions{}, 1},
+		{"downloads only", CopyOptions{MaxParallelDownloads: 8}, 8},
+		{"uploads only", CopyOptions{MaxParallelUploads: 3}, 1},
+		{"uploads tighten downloads", CopyOptions{MaxParallelDownloads: 8, MaxParallelUploads: 3}, 3},
+		{"downloads tighten uploads", CopyOptions{MaxParallelDownloads: 2, MaxParallelUploads: 8}, 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := effectiveBlobParallelism(nil, tc.options); got != tc.expected {
+				t.Errorf("effectiveBlobParallelism(nil, %+v) = %d, want %d", tc.options, got, tc.expected)
+			}
+		})
+	}
+}
+
+// fakeSerializingDestination implements destinationSerializesBlobWrites by embedding a nil
+// private.ImageDestination (these tests never call its other methods).
+type fakeSerializingDestination struct {
+	private.ImageDestination
+	mustSerialize bool
+}
+
+func (f *fakeSerializingDestination) MustSerializeBlobWrites() bool { return f.mustSerialize }
+
+func TestEffectiveBlobParallelismForcesSerialForSerializingDestination(t *testing.T) {
+	dest := &fakeSerializingDestination{mustSerialize: true}
+	options := CopyOptions{MaxParallelDownloads: 8, MaxParallelUploads: 8}
+	if got := effectiveBlobParallelism(dest, options); got != 1 {
+		t.Errorf("effectiveBlobParallelism(serializing dest, %+v) = %d, want 1 regardless of CopyOptions", options, got)
+	}
+}
+
+func TestNewCopierConstructsBlobDedupeOnlyWhenParallel(t *testing.T) {
+	if c := newCopier(nil, nil, CopyOptions{}); c.blobDedupe != nil {
+		t.Error("blobDedupe should be nil without parallelism configured")
+	}
+	if c := newCopier(nil, nil, CopyOptions{MaxParallelDownloads: 4}); c.blobDedupe == nil {
+		t.Error("blobDedupe should be constructed once parallelism is configured")
+	}
+}
+
+func BenchmarkRunBounded(b *testing.B) {
+	for _, maxConcurrency := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(maxConcurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				runBounded(100, maxConcurrency, func(int) {})
+			}
+		})
+	}
+}
+
+// perWorkerBufferSize approximates the size of the decompression buffer a single copyBlobFromStream
+// pipeline keeps live at once; it is what the caller actually pays for every unit of
+// MaxParallelDownloads/MaxParallelUploads, unlike runBounded's own empty-closure scheduling cost.
+const perWorkerBufferSize = 32 * 1024
+
+// perWorkerBufferSink keeps each benchmark buffer reachable, so that it is allocated on the heap
+// and counted by ReportAllocs instead of living on the goroutine's stack.
+var perWorkerBufferSink atomic.Value
+
+// BenchmarkBlobCopyMemoryPerWorker reports the allocation cost of running N blobs' worth of
+// decompression buffers at varying concurrency, to justify what MaxParallelDownloads/
+// MaxParallelUploads actually costs in memory, not just in scheduling overhead.
+func BenchmarkBlobCopyMemoryPerWorker(b *testing.B) {
+	for _, maxConcurrency := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(maxConcurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				runBounded(100, maxConcurrency, func(int) {
+					buf := make([]byte, perWorkerBufferSize)
+					perWorkerBufferSink.Store(buf)
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package copy
+
+import (
+	"context"
+
+	"github.com/containers/image/v5/types"
+)
+
+// BlobPipelineStage is a single, independently pluggable step in the blob-copying pipeline driven
+// by copyBlobFromStream. Callers register stages via CopyOptions.AdditionalBlobPipelineStages to
+// extend the pipeline without copyBlobFromStream needing to know anything about what the stage
+// actually does, e.g. attestation signing, SBOM extraction, computing additional integrity
+// digests (SHA-512, BLAKE3, …), or teeing the stream to an external sink.
+//
+// Stage ordering is NOT caller-controlled: digest verification of the source always happens
+// first, before any stage (including caller-supplied ones) sees the stream, and encryption, if
+// requested, always happens last, immediately before the stream reaches dest.PutBlobWithOptions.
+// Caller-supplied stages run, in registration order, between decompression/compression and
+// encryption.
+type BlobPipelineStage interface {
+	// run updates *stream to wrap its reader with whatever processing this stage needs, and
+	// returns a finalizer to be called, after the blob has been fully uploaded, to fold any
+	// metadata the stage collected into the uploaded blob info.
+	//
+	// Implementations MUST NOT consume stream.reader themselves; they must wrap it and store
+	// the wrapped reader back into stream.reader.
+	run(ctx context.Context, stream *sourceStream) (BlobPipelineStageFinalizer, error)
+}
+
+// BlobPipelineStageFinalizer is returned by BlobPipelineStage.run. It is called, in registration
+// order, once dest.PutBlobWithOptions has returned successfully, so that the stage can record
+// metadata (e.g. an extra digest, a signature reference) into uploadedInfo.Annotations, and
+// release any resources (e.g. close a tee sink) it is holding.
+type BlobPipelineStageFinalizer func(uploadedInfo *types.BlobInfo) error
+
+// additionalBlobPipelineStages runs the caller-supplied BlobPipelineStages registered for a copy,
+// tracking the finalizers so that they can be invoked, in order, once the blob has been uploaded.
+type additionalBlobPipelineStages struct {
+	stages     []BlobPipelineStage
+	finalizers []BlobPipelineStageFinalizer // one per entry in stages that has already run
+}
+
+// blobPipelineAdditionalStages runs c.additionalBlobPipelineStages against stream,
+// updating *stream to include their processing and returning a handle used to finalize them
+// once the blob has been uploaded.
+func (c *copier) blobPipelineAdditionalStages(ctx context.Context, stream *sourceStream) (*additionalBlobPipelineStages, error) {
+	res := &additionalBlobPipelineStages{
+		stages: c.additionalBlobPipelineStages,
+	}
+	for _, stage := range res.stages {
+		finalizer, err := stage.run(ctx, stream)
+		if err != nil {
+			return nil, err
+		}
+		res.finalizers = append(res.finalizers, finalizer)
+	}
+	return res, nil
+}
+
+// updateEdits calls every stage’s finalizer, in registration order, folding the results into
+// uploadedInfo.
+func (s *additionalBlobPipelineStages) updateEdits(uploadedInfo *types.BlobInfo) error {
+	for _, finalizer := range s.finalizers {
+		if err := finalizer(uploadedInfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package copy
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+)
+
+// recordingStage is a BlobPipelineStage that records whether it ran and sets an annotation on
+// finalize, so tests can observe both halves of the BlobPipelineStage contract.
+type recordingStage struct {
+	ran      bool
+	finalize bool
+}
+
+func (s *recordingStage) run(_ context.Context, stream *sourceStream) (BlobPipelineStageFinalizer, error) {
+	s.ran = true
+	return func(uploadedInfo *types.BlobInfo) error {
+		s.finalize = true
+		if uploadedInfo.Annotations == nil {
+			uploadedInfo.Annotations = map[string]string{}
+		}
+		uploadedInfo.Annotations["recordingStage.ran"] = "true"
+		return nil
+	}, nil
+}
+
+func TestCopyOptionsAdditionalBlobPipelineStagesRuns(t *testing.T) {
+	stage := &recordingStage{}
+	c := newCopier(nil, nil, CopyOptions{AdditionalBlobPipelineStages: []BlobPipelineStage{stage}})
+
+	stream := &sourceStream{reader: bytes.NewReader([]byte("hello"))}
+	additionalStages, err := c.blobPipelineAdditionalStages(context.Background(), stream)
+	if err != nil {
+		t.Fatalf("blobPipelineAdditionalStages: %v", err)
+	}
+	if !stage.ran {
+		t.Error("registered stage's run was never called")
+	}
+
+	uploadedInfo := types.BlobInfo{}
+	if err := additionalStages.updateEdits(&uploadedInfo); err != nil {
+		t.Fatalf("updateEdits: %v", err)
+	}
+	if !stage.finalize {
+		t.Error("registered stage's finalizer was never called")
+	}
+	if uploadedInfo.Annotations["recordingStage.ran"] != "true" {
+		t.Error("finalizer's edits were not folded into uploadedInfo")
+	}
+}
+
+func TestCopyOptionsWithNoAdditionalStagesIsANoOp(t *testing.T) {
+	c := newCopier(nil, nil, CopyOptions{})
+	stream := &sourceStream{reader: bytes.NewReader(nil)}
+	additionalStages, err := c.blobPipelineAdditionalStages(context.Background(), stream)
+	if err != nil {
+		t.Fatalf("blobPipelineAdditionalStages: %v", err)
+	}
+	uploadedInfo := types.BlobInfo{}
+	if err := additionalStages.updateEdits(&uploadedInfo); err != nil {
+		t.Fatalf("updateEdits: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package copy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containers/image/v5/internal/private"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrResumeUnsupported is returned by ResumableBlobDestination.ResumePutBlob when it cannot
+// resume this particular upload (e.g. the destination no longer has any record of it, or the
+// transport lost its range/offset support). copyBlobFromStream reacts by forgetting the
+// checkpoint and restarting the blob from byte 0, exactly as if no ResumeStore had been
+// configured.
+var ErrResumeUnsupported = errors.New("resuming this blob upload is not supported")
+
+// ResumableBlobDestination is implemented by destinations that can continue a blob upload that was
+// interrupted partway through, instead of requiring every attempt to (re)send the complete blob
+// from byte 0. copyBlobFromStream only ever skips re-sending already-accepted bytes when c.dest
+// implements this interface; a plain PutBlobWithOptions call always receives, and is required to
+// store, the complete blob, so there is no risk of a destination silently mistaking a partial
+// stream for a whole one.
+type ResumableBlobDestination interface {
+	// ResumePutBlob continues uploading the blob described by srcInfo, whose first resumeOffset
+	// bytes were already durably accepted by a previous, interrupted attempt. reader provides
+	// exactly the remaining bytes of the (uncompressed-pipeline) stream, starting at
+	// resumeOffset, not from the beginning. resumeData is the destination-specific continuation
+	// token last reported via a NoteUploadProgress call on reader (or one of the readers it
+	// wraps), if any. It returns ErrResumeUnsupported if this particular upload can no longer be
+	// resumed, in which case the caller restarts the whole blob from scratch.
+	ResumePutBlob(ctx context.Context, reader io.Reader, srcInfo types.BlobInfo, options private.PutBlobOptions, resumeOffset int64, resumeData []byte) (types.BlobInfo, error)
+}
+
+// BlobUploadProgressNotifier is implemented by the io.Reader (or any reader it wraps) passed to
+// ResumableBlobDestination.ResumePutBlob and to plain PutBlobWithOptions calls, letting the
+// destination report how much of the stream it has durably accepted so far, and an updated
+// continuation token to resume from that point. errorAnnotationReader forwards calls to it down
+// the reader chain; resumeCheckpointReader is what ultimately records them.
+type BlobUploadProgressNotifier interface {
+	NoteUploadProgress(uploadedBytes int64, resumeData []byte)
+}
+
+// BlobResumeCheckpoint is the state copyBlobFromStream needs to resume an interrupted upload of a
+// single blob: how much of the source has already been consumed and validated, how much of that
+// dest has durably accepted, and the destination's own continuation token for what it has stored
+// so far.
+//
+// SourceBytesConsumed and DestBytesConsumed are offsets into two different streams and must not be
+// confused: SourceBytesConsumed counts raw bytes read from srcReader, before any
+// decryption/decompression/compression copyBlobFromStream performs, and is what a retry must Seek
+// srcReader to; DestBytesConsumed counts bytes of the (possibly transformed) stream dest has
+// actually been sent, and is what a ResumableBlobDestination's resumeOffset means. Whenever
+// copyBlobFromStream forces canModifyBlob to false for a blob it is tracking a checkpoint for (it
+// always does, for exactly this reason — see copyBlobFromStream), compression can never run and
+// these two values stay equal; they are kept as separate fields so that remains true by
+// construction rather than by a coincidence callers could accidentally break.
+type BlobResumeCheckpoint struct {
+	SourceBytesConsumed int64  // Raw bytes of srcReader read and validated so far; Seek srcReader to this offset to retry.
+	DestBytesConsumed   int64  // Bytes of the stream dest has durably accepted so far; this is dest's resume offset.
+	DigestState         []byte // Serialized state of the in-progress digest computation over SourceBytesConsumed bytes; see (*digestingReader).serializeState.
+	UploadResumeData    []byte // Opaque destination-specific continuation token (e.g. a chunked-upload URL), as last reported via NoteUploadProgress.
+}
+
+// ResumeStore persists BlobResumeCheckpoints across copyBlobFromStream retries, keyed by a value
+// that identifies the particular (source, destination, blob) triple being copied. Callers that
+// want resumable uploads pass an implementation via CopyOptions; copyBlobFromStream periodically
+// calls Save while a blob is in flight, Load at the start of a copy to pick up where a previous
+// attempt left off, and Delete once the blob has been fully and successfully uploaded (or once a
+// checkpoint turns out to be unusable).
+type ResumeStore interface {
+	Save(ctx context.Context, key string, checkpoint BlobResumeCheckpoint) error
+	Load(ctx context.Context, key string) (BlobResumeCheckpoint, bool, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// blobResumeKey identifies srcInfo's blob for c.resumeStore, scoped to this copier's destination
+// so that checkpoints for the same digest copied to two different destinations don't collide.
+func (c *copier) blobResumeKey(srcInfo types.BlobInfo) string {
+	return c.dest.Reference().Transport().Name() + "/" + c.dest.Reference().StringWithinTransport() + "@" + srcInfo.Digest.String()
+}
+
+// loadBlobResumeCheckpoint returns a previously-saved checkpoint for srcInfo, if c.resumeStore is
+// configured and has one and c.dest can actually resume an upload; ok is false whenever there is
+// nothing usable to resume from, and the source must be read from byte 0.
+func (c *copier) loadBlobResumeCheckpoint(ctx context.Context, srcInfo types.BlobInfo) (checkpoint BlobResumeCheckpoint, ok bool, err error) {
+	if c.resumeStore == nil || srcInfo.Digest == "" {
+		return BlobResumeCheckpoint{}, false, nil
+	}
+	if _, ok := c.dest.(ResumableBlobDestination); !ok {
+		return BlobResumeCheckpoint{}, false, nil
+	}
+	return c.resumeStore.Load(ctx, c.blobResumeKey(srcInfo))
+}
+
+// defaultResumeCheckpointInterval is how often, in bytes of source consumed, resumeCheckpointReader
+// persists a new BlobResumeCheckpoint: frequent enough to bound how much a retry has to replay,
+// infrequent enough not to turn the store into a bottleneck.
+const defaultResumeCheckpointInterval = 8 * 1024 * 1024
+
+// resumeCheckpointReader wraps the blob pipeline's stream.reader to periodically persist a
+// BlobResumeCheckpoint to a ResumeStore, so that a later retry of the same blob can pick up close
+// to where this attempt left off instead of restarting from byte 0. It also implements
+// BlobUploadProgressNotifier, so that dest can report its own continuation token for what it has
+// durably accepted; that token is included in the next checkpoint saved.
+type resumeCheckpointReader struct {
+	ctx                 context.Context
+	reader              io.Reader
+	store               ResumeStore
+	key                 string
+	destBaseOffset      int64         // Dest-accepted bytes already consumed before this reader started (0 unless itself resuming).
+	sourceBytesConsumed func() int64  // returns the raw, pre-transform bytes consumed from srcReader so far; see (*digestingReader).rawBytesConsumed.
+	digestState         func() []byte // returns the digest computation's current serialized state
+	bytesConsumed       int64         // Dest-accepted (post-transform) bytes this reader instance has itself seen.
+	nextSaveAt          int64
+
+	mutex            sync.Mutex
+	uploadResumeData []byte // Most recently reported by NoteUploadProgress, if any.
+}
+
+func newResumeCheckpointReader(ctx context.Context, reader io.Reader, store ResumeStore, key string, destBaseOffset int64, sourceBytesConsumed func() int64, digestState func() []byte) *resumeCheckpointReader {
+	return &resumeCheckpointReader{
+		ctx:                 ctx,
+		reader:              reader,
+		store:               store,
+		key:                 key,
+		destBaseOffset:      destBaseOffset,
+		sourceBytesConsumed: sourceBytesConsumed,
+		digestState:         digestState,
+		nextSaveAt:          defaultResumeCheckpointInterval,
+	}
+}
+
+func (r *resumeCheckpointReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bytesConsumed += int64(n)
+	if r.bytesConsumed >= r.nextSaveAt {
+		r.nextSaveAt = r.bytesConsumed + defaultResumeCheckpointInterval
+		r.save()
+	}
+	return n, err
+}
+
+// save persists the current progress to r.store. A failed save only means a future retry replays
+// more of the blob than strictly necessary, so it must not turn into a copy failure.
+func (r *resumeCheckpointReader) save() {
+	r.mutex.Lock()
+	checkpoint := BlobResumeCheckpoint{
+		DestBytesConsumed: r.destBaseOffset + r.bytesConsumed,
+		UploadResumeData:  r.uploadResumeData,
+	}
+	r.mutex.Unlock()
+	if r.sourceBytesConsumed != nil {
+		checkpoint.SourceBytesConsumed = r.sourceBytesConsumed()
+	}
+	if r.digestState != nil {
+		checkpoint.DigestState = r.digestState()
+	}
+	if err := r.store.Save(r.ctx, r.key, checkpoint); err != nil {
+		logrus.Debugf("saving resume checkpoint for %s: %v", r.key, err)
+	}
+}
+
+// NoteUploadProgress implements BlobUploadProgressNotifier, recording dest's own continuation
+// token so the next saved checkpoint carries it.
+func (r *resumeCheckpointReader) NoteUploadProgress(_ int64, resumeData []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.uploadResumeData = resumeData
+}
+
+// forgetBlobResumeCheckpoint deletes any checkpoint saved for key, once the blob has been fully
+// and successfully uploaded, or once a checkpoint has turned out to be unusable, and there is
+// nothing left to resume.
+func (c *copier) forgetBlobResumeCheckpoint(ctx context.Context, key string) {
+	if err := c.resumeStore.Delete(ctx, key); err != nil {
+		logrus.Debugf("deleting resume checkpoint for %s: %v", key, err)
+	}
+}
@@ -0,0 +1,66 @@
+package copy
+
+import (
+	"time"
+
+	"github.com/containers/image/v5/internal/private"
+	"github.com/containers/image/v5/types"
+)
+
+// CopyOptions collects the knobs that control how copier copies blobs. This is the subset of the
+// full image-copy option set that the blob pipeline in this package reads directly; the
+// higher-level per-image copy orchestration carries its own additional options alongside these.
+type CopyOptions struct {
+	// AdditionalBlobPipelineStages are run against every blob copied by copyBlobFromStream, after
+	// decompression/compression and before encryption. See BlobPipelineStage.
+	AdditionalBlobPipelineStages []BlobPipelineStage
+	// ChunkedTOCParser, if set, lets copyBlobFromStream record a table of contents for
+	// zstd:chunked/eStargz layers as they are uploaded, so that a later copy of the same layer
+	// can use tryReusingBlobChunked's partial-pull fast path instead of streaming it in full.
+	ChunkedTOCParser ChunkedTOCParser
+	// MaxParallelDownloads bounds how many of the blobs passed to a single copyBlobs call have
+	// their copyBlobFromStream pipeline running at once. 0 means "no additional parallelism",
+	// matching previous behavior. See effectiveBlobParallelism.
+	MaxParallelDownloads uint
+	// MaxParallelUploads further restricts MaxParallelDownloads' concurrency, for destinations
+	// that can only accept a smaller number of concurrent blob uploads; it can only lower the
+	// effective limit, never raise it. See effectiveBlobParallelism.
+	MaxParallelUploads uint
+	// ResumeStore, if set, lets copyBlobFromStream save progress on each blob it copies and
+	// resume an interrupted upload on a later retry, for destinations implementing
+	// ResumableBlobDestination. See ResumeStore.
+	ResumeStore ResumeStore
+}
+
+// copier carries the state shared across every blob copied by a single Image copy operation.
+type copier struct {
+	dest             private.ImageDestination
+	blobInfoCache    types.BlobInfoCache
+	progress         chan types.ProgressProperties
+	progressInterval time.Duration
+
+	additionalBlobPipelineStages []BlobPipelineStage
+	chunkedTOCParser             ChunkedTOCParser
+	maxParallelBlobCopies        int
+	blobDedupe                   *blobDigestGate // non-nil whenever maxParallelBlobCopies > 1; see copyBlobFromStream.
+	resumeStore                  ResumeStore
+}
+
+// newCopier creates a copier applying options on top of dest/blobInfoCache, which every
+// copyBlobFromStream call made through it shares.
+func newCopier(dest private.ImageDestination, blobInfoCache types.BlobInfoCache, options CopyOptions) *copier {
+	maxParallelBlobCopies := effectiveBlobParallelism(dest, options)
+	var blobDedupe *blobDigestGate
+	if maxParallelBlobCopies > 1 {
+		blobDedupe = newBlobDigestGate()
+	}
+	return &copier{
+		dest:                         dest,
+		blobInfoCache:                blobInfoCache,
+		additionalBlobPipelineStages: options.AdditionalBlobPipelineStages,
+		chunkedTOCParser:             options.ChunkedTOCParser,
+		maxParallelBlobCopies:        maxParallelBlobCopies,
+		blobDedupe:                   blobDedupe,
+		resumeStore:                  options.ResumeStore,
+	}
+}
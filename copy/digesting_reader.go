@@ -0,0 +1,118 @@
+package copy
+
+import (
+	"encoding"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// digestingReader validates a stream against expectedDigest as it is read, if expectedDigest is
+// set, and always makes the digest it has actually observed available via digest() — including
+// for sources that only learn their own digest once the stream has been fully consumed.
+type digestingReader struct {
+	source              io.Reader
+	expectedDigest      digest.Digest
+	digester            digest.Digester
+	validationFailed    bool  // Set on EOF if expectedDigest was set and did not match.
+	validationSucceeded bool  // Set on EOF if expectedDigest was set and matched.
+	rawBytesRead        int64 // Bytes read from source so far, including any baseOffset carried over by newDigestingReaderResuming.
+}
+
+// newDigestingReader returns a digestingReader which validates source against expectedDigest as
+// it is read, failing the Read that reaches EOF if they differ. If expectedDigest is "", the reader computes a digest (using the canonical
+// algorithm) without validating it against anything; callers needing that computed value call
+// digest() once source has been read to EOF.
+func newDigestingReader(source io.Reader, expectedDigest digest.Digest) (*digestingReader, error) {
+	algorithm := digest.Canonical
+	if expectedDigest != "" {
+		if err := expectedDigest.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid digest %q", expectedDigest)
+		}
+		algorithm = expectedDigest.Algorithm()
+	}
+	return &digestingReader{
+		source:         source,
+		expectedDigest: expectedDigest,
+		digester:       algorithm.Digester(),
+	}, nil
+}
+
+// newDigestingReaderResuming is like newDigestingReader, but seeds the digest computation from
+// state previously captured by (*digestingReader).serializeState, so that a reader continuing to
+// consume a source that has been seeked forward (to resume an interrupted upload) ends up with the
+// digest of the whole blob, not just of the tail it itself reads. baseOffset is the number of bytes
+// already read from source before this reader started (i.e. how far it was seeked forward); it is
+// reflected in rawBytesConsumed so that value remains an absolute offset into the original stream,
+// not just a count of what this particular reader instance has seen.
+func newDigestingReaderResuming(source io.Reader, expectedDigest digest.Digest, baseOffset int64, state []byte) (*digestingReader, error) {
+	r, err := newDigestingReader(source, expectedDigest)
+	if err != nil {
+		return nil, err
+	}
+	r.rawBytesRead = baseOffset
+	if state == nil {
+		return r, nil
+	}
+	unmarshaler, ok := r.digester.Hash().(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil, errors.Errorf("digest algorithm %s does not support resuming a partial hash computation", r.digester.Digest().Algorithm())
+	}
+	if err := unmarshaler.UnmarshalBinary(state); err != nil {
+		return nil, errors.Wrap(err, "restoring digest state to resume a partial blob upload")
+	}
+	return r, nil
+}
+
+// serializeState captures the digest computation's current internal state, so that a later
+// newDigestingReaderResuming call can continue hashing from exactly this point instead of from
+// byte 0. It returns nil if the algorithm in use doesn't support this (e.g. its hash.Hash
+// implementation does not implement encoding.BinaryMarshaler); callers must then fall back to
+// hashing the blob again from the start.
+func (d *digestingReader) serializeState() []byte {
+	marshaler, ok := d.digester.Hash().(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+// digest returns the digest of everything read from source so far. Call this only after source
+// has been read to EOF to get the digest of the complete blob.
+func (d *digestingReader) digest() digest.Digest {
+	return d.digester.Digest()
+}
+
+// rawBytesConsumed returns the number of bytes read from source so far, as an absolute offset into
+// the original (pre-seek, pre-compression, pre-encryption) stream — including any baseOffset this
+// reader was constructed with via newDigestingReaderResuming. Callers needing to resume an
+// interrupted upload must Seek the raw source reader to this value, not to a byte count measured
+// further down the pipeline after compression or encryption have changed the data's length.
+func (d *digestingReader) rawBytesConsumed() int64 {
+	return d.rawBytesRead
+}
+
+func (d *digestingReader) Read(p []byte) (int, error) {
+	n, err := d.source.Read(p)
+	if n > 0 {
+		d.rawBytesRead += int64(n)
+		if n2, err2 := d.digester.Hash().Write(p[:n]); err2 != nil || n2 != n {
+			// Coverage: hash.Hash.Write is documented to never return an error.
+			return 0, errors.Wrap(err2, "updating digest")
+		}
+	}
+	if err == io.EOF && d.expectedDigest != "" {
+		actualDigest := d.digester.Digest()
+		if actualDigest != d.expectedDigest {
+			d.validationFailed = true
+			return n, errors.Errorf("Digest did not match, expected %s, got %s", d.expectedDigest, actualDigest)
+		}
+		d.validationSucceeded = true
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package copy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestDigestingReaderComputesDigestWhenNoneExpected(t *testing.T) {
+	content := []byte("hello world")
+	r, err := newDigestingReader(bytes.NewReader(content), "")
+	if err != nil {
+		t.Fatalf("newDigestingReader: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if r.digest() != digest.FromBytes(content) {
+		t.Errorf("digest() = %s, want %s", r.digest(), digest.FromBytes(content))
+	}
+	if r.validationFailed || r.validationSucceeded {
+		t.Error("validation flags should be untouched when no digest was expected")
+	}
+}
+
+func TestDigestingReaderValidatesExpectedDigest(t *testing.T) {
+	content := []byte("hello world")
+	expected := digest.FromBytes(content)
+
+	r, err := newDigestingReader(bytes.NewReader(content), expected)
+	if err != nil {
+		t.Fatalf("newDigestingReader: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if !r.validationSucceeded || r.validationFailed {
+		t.Errorf("validationSucceeded=%v validationFailed=%v, want true/false", r.validationSucceeded, r.validationFailed)
+	}
+
+	r2, err := newDigestingReader(bytes.NewReader([]byte("goodbye world")), expected)
+	if err != nil {
+		t.Fatalf("newDigestingReader: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r2); err == nil {
+		t.Fatal("reading a blob that does not match the expected digest succeeded, want an error")
+	}
+	if r2.validationSucceeded || !r2.validationFailed {
+		t.Errorf("validationSucceeded=%v validationFailed=%v, want false/true", r2.validationSucceeded, r2.validationFailed)
+	}
+}
+
+func TestDigestingReaderRejectsInvalidExpectedDigest(t *testing.T) {
+	if _, err := newDigestingReader(bytes.NewReader(nil), digest.Digest("not-a-digest")); err == nil {
+		t.Error("expected an error for an invalid expected digest, got none")
+	}
+}
+
+func TestDigestingReaderResumingContinuesFromSerializedState(t *testing.T) {
+	content := []byte("hello world, this is a longer blob so splitting it in half is meaningful")
+	split := len(content) / 2
+
+	r1, err := newDigestingReader(bytes.NewReader(content[:split]), "")
+	if err != nil {
+		t.Fatalf("newDigestingReader: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r1); err != nil {
+		t.Fatalf("reading first half: %v", err)
+	}
+	state := r1.serializeState()
+	if state == nil {
+		t.Fatal("serializeState returned nil for the canonical (sha256) algorithm, which supports it")
+	}
+
+	r2, err := newDigestingReaderResuming(bytes.NewReader(content[split:]), "", int64(split), state)
+	if err != nil {
+		t.Fatalf("newDigestingReaderResuming: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r2); err != nil {
+		t.Fatalf("reading second half: %v", err)
+	}
+
+	if r2.digest() != digest.FromBytes(content) {
+		t.Errorf("resumed digest = %s, want %s (digest of the whole blob)", r2.digest(), digest.FromBytes(content))
+	}
+	if want := int64(len(content)); r2.rawBytesConsumed() != want {
+		t.Errorf("rawBytesConsumed() = %d, want %d (baseOffset %d + bytes read by r2)", r2.rawBytesConsumed(), want, split)
+	}
+}
+
+func TestDigestingReaderResumingWithNilStateStartsFresh(t *testing.T) {
+	content := []byte("hello world")
+	r, err := newDigestingReaderResuming(bytes.NewReader(content), "", 0, nil)
+	if err != nil {
+		t.Fatalf("newDigestingReaderResuming: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if r.digest() != digest.FromBytes(content) {
+		t.Errorf("digest() = %s, want %s", r.digest(), digest.FromBytes(content))
+	}
+	if r.rawBytesConsumed() != int64(len(content)) {
+		t.Errorf("rawBytesConsumed() = %d, want %d", r.rawBytesConsumed(), len(content))
+	}
+}